@@ -0,0 +1,149 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package deps
+
+import "strings"
+
+// Normalizer maps a resolved package path to the node it should be
+// collapsed into. Packages that normalize to the same value are merged into
+// a single node by collapseDependencies.
+type Normalizer func(Package) Package
+
+// CollapseRule collapses any package whose path has Prefix into To.
+type CollapseRule struct {
+	Prefix string
+	To     Package
+}
+
+// CollapsePrefixes builds a Normalizer from an ordered list of prefix
+// rules. The longest matching Prefix wins; a package matching no rule is
+// left unchanged.
+func CollapsePrefixes(rules []CollapseRule) Normalizer {
+	return func(pkg Package) Package {
+		best := -1
+		var to Package
+		for _, rule := range rules {
+			if !strings.HasPrefix(string(pkg), rule.Prefix) {
+				continue
+			}
+			if len(rule.Prefix) > best {
+				best = len(rule.Prefix)
+				to = rule.To
+			}
+		}
+		if best == -1 {
+			return pkg
+		}
+		return to
+	}
+}
+
+// knownMultiSegmentHosts lists import path prefixes whose "repository root"
+// spans three path segments (host/user/repo) rather than two. This mirrors
+// the heuristic Glide's NormalizeName uses to guess a GOPATH package's
+// repository root when no module metadata is available.
+var knownMultiSegmentHosts = []string{
+	"golang.org/x/",
+	"google.golang.org/",
+	"gopkg.in/",
+}
+
+// NormalizeModulePath collapses a package path down to its likely
+// repository (module) root using a three-segment heuristic: for a
+// recognized multi-segment host (golang.org/x/..., gopkg.in/..., etc.) or
+// any other host with at least three path segments (host/user/repo), the
+// first three segments are kept; otherwise the path is returned unchanged.
+// This is only a fallback for GOPATH-style projects; when module metadata
+// is available (see CollapseToModule), it should be preferred.
+func NormalizeModulePath(pkg Package) Package {
+	parts := strings.Split(string(pkg), "/")
+	if len(parts) < 3 {
+		return pkg
+	}
+	for _, host := range knownMultiSegmentHosts {
+		if strings.HasPrefix(string(pkg), host) {
+			return Package(strings.Join(parts[:3], "/"))
+		}
+	}
+	if strings.Contains(parts[0], ".") {
+		// Looks like a hostname (e.g. github.com), so segment 2 is the
+		// user/org and segment 3 is the repository.
+		return Package(strings.Join(parts[:3], "/"))
+	}
+	return pkg
+}
+
+// collapseNormalizer resolves the Normalizer that Build should apply, per
+// the CollapseTo/CollapseToModule fields documented on Builder.
+func (b *Builder) collapseNormalizer() Normalizer {
+	if b.CollapseTo != nil {
+		return b.CollapseTo
+	}
+	if !b.CollapseToModule {
+		return nil
+	}
+	if len(b.moduleOf) == 0 {
+		// No module metadata was collected (e.g. GoBuildLoader), so fall
+		// back to the GOPATH heuristic for every package.
+		return NormalizeModulePath
+	}
+	moduleOf := b.moduleOf
+	return func(pkg Package) Package {
+		if mod, ok := moduleOf[pkg]; ok {
+			return mod
+		}
+		return NormalizeModulePath(pkg)
+	}
+}
+
+// collapseDependencies rewrites deps under normalize, merging nodes that
+// normalize to the same package, summing their LOC (and its GoLOC/CgoLOC/
+// AsmLOC/CLOC breakdown, keeping DependencyInfo's LOC == sum-of-breakdown
+// invariant intact), and dropping edges that become self-edges as a result
+// of the merge.
+func collapseDependencies(deps Dependencies, normalize Normalizer) Dependencies {
+	collapsed := Dependencies{
+		Forward: NewGraph(),
+		Ignored: NewSet(),
+		Info:    make(map[Package]*DependencyInfo),
+	}
+
+	for pkg := range deps.Ignored {
+		collapsed.Ignored.Insert(normalize(pkg))
+	}
+
+	for pkg, children := range deps.Forward {
+		from := normalize(pkg)
+		collapsed.Forward.Pkg(from)
+
+		if info := deps.Info[pkg]; info != nil {
+			merged, ok := collapsed.Info[from]
+			if !ok {
+				merged = &DependencyInfo{}
+				collapsed.Info[from] = merged
+			}
+			merged.LOC += info.LOC
+			merged.GoLOC += info.GoLOC
+			merged.CgoLOC += info.CgoLOC
+			merged.AsmLOC += info.AsmLOC
+			merged.CLOC += info.CLOC
+		}
+
+		for child := range children {
+			to := normalize(child)
+			if to == from {
+				// Dropped: both endpoints collapsed into the same node.
+				continue
+			}
+			collapsed.Forward.Pkg(from).Insert(to)
+		}
+	}
+
+	return collapsed
+}
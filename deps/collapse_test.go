@@ -0,0 +1,88 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package deps
+
+import "testing"
+
+func TestCollapsePrefixes(t *testing.T) {
+	normalize := CollapsePrefixes([]CollapseRule{
+		{Prefix: "golang.org/x/crypto/", To: "golang.org/x/crypto"},
+		{Prefix: "golang.org/x/crypto/ssh/", To: "golang.org/x/crypto/ssh"},
+	})
+
+	cases := []struct {
+		in   Package
+		want Package
+	}{
+		{"golang.org/x/crypto/ssh/agent", "golang.org/x/crypto/ssh"}, // longest prefix wins
+		{"golang.org/x/crypto/ed25519", "golang.org/x/crypto"},
+		{"golang.org/x/net/http2", "golang.org/x/net/http2"}, // no matching rule
+	}
+	for _, c := range cases {
+		if got := normalize(c.in); got != c.want {
+			t.Errorf("normalize(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestNormalizeModulePath(t *testing.T) {
+	cases := []struct {
+		in   Package
+		want Package
+	}{
+		{"github.com/foo/bar/baz/qux", "github.com/foo/bar"},
+		{"golang.org/x/crypto/ssh", "golang.org/x/crypto"},
+		{"gopkg.in/yaml.v2", "gopkg.in/yaml.v2"}, // only two segments, left as-is
+		{"fmt", "fmt"},
+	}
+	for _, c := range cases {
+		if got := NormalizeModulePath(c.in); got != c.want {
+			t.Errorf("NormalizeModulePath(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestCollapseDependencies(t *testing.T) {
+	deps := Dependencies{
+		Forward: NewGraph(),
+		Ignored: NewSet(),
+		Info:    make(map[Package]*DependencyInfo),
+	}
+	deps.Forward.Pkg("golang.org/x/crypto/ssh").Insert("golang.org/x/crypto/ed25519")
+	deps.Forward.Pkg("golang.org/x/crypto/ssh").Insert("fmt")
+	deps.Forward.Pkg("golang.org/x/crypto/ed25519")
+	deps.Forward.Pkg("fmt")
+
+	deps.Info["golang.org/x/crypto/ssh"] = &DependencyInfo{LOC: 10, GoLOC: 8, CgoLOC: 2}
+	deps.Info["golang.org/x/crypto/ed25519"] = &DependencyInfo{LOC: 5, GoLOC: 5}
+	deps.Info["fmt"] = &DependencyInfo{LOC: 100, GoLOC: 100}
+
+	collapsed := collapseDependencies(deps, NormalizeModulePath)
+
+	if collapsed.Forward.Has("golang.org/x/crypto/ssh") {
+		t.Fatalf("collapsed graph should not retain the pre-collapse node")
+	}
+	if !collapsed.Forward.Has("golang.org/x/crypto") {
+		t.Fatalf("collapsed graph is missing the merged node")
+	}
+	if collapsed.Forward.Pkg("golang.org/x/crypto").Has("golang.org/x/crypto") {
+		t.Errorf("self-edge produced by collapsing two packages into one node should be dropped")
+	}
+	if !collapsed.Forward.Pkg("golang.org/x/crypto").Has("fmt") {
+		t.Errorf("edge to an uncollapsed package should survive")
+	}
+
+	info := collapsed.Info["golang.org/x/crypto"]
+	if info == nil {
+		t.Fatalf("missing Info for collapsed node")
+	}
+	if info.LOC != 15 || info.GoLOC != 13 || info.CgoLOC != 2 {
+		t.Errorf("LOC breakdown not summed correctly: %+v", info)
+	}
+}
@@ -14,11 +14,11 @@ import (
 	"fmt"
 	"go/build"
 	"io"
-	"log"
 	"os"
-	"path/filepath"
 	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 )
 
 type Dependencies struct {
@@ -27,11 +27,37 @@ type Dependencies struct {
 	// Packages which were ignored.
 	Ignored Set
 	Info    map[Package]*DependencyInfo
+
+	// PerContext holds the individual result of building against each
+	// build.Context in Builder.Matrix, keyed by ContextLabel. Only
+	// populated when Matrix is non-empty.
+	PerContext map[string]Dependencies
+	// EdgeContexts records, for each edge in the merged Forward graph
+	// produced from Builder.Matrix, which contexts' graphs contained it.
+	// Only populated when Matrix is non-empty. An edge that comes from a file
+	// only some contexts accept is still listed under every context whose
+	// graph reaches the importing package, since each context's build also
+	// follows the imports of files its sibling contexts accept.
+	EdgeContexts map[Edge][]string
 }
 
 type DependencyInfo struct {
+	// LOC is the total line count across every source file counted for
+	// this package: GoLOC + CgoLOC + AsmLOC + CLOC.
 	LOC int
-	// TODO: Add recursive LOC (but don't double count packages)
+	// GoLOC, CgoLOC, AsmLOC, and CLOC break LOC down by the language of the
+	// source files it was counted from (pkg.GoFiles, plus TestGoFiles and
+	// XTestGoFiles when IncludeTests is set; pkg.CgoFiles;
+	// pkg.SFiles; and pkg.CFiles/CXXFiles/HFiles, respectively).
+	GoLOC  int
+	CgoLOC int
+	AsmLOC int
+	CLOC   int
+	// RecursiveLOC is LOC summed over this package and every package it
+	// depends on, directly or transitively, counting each shared dependency
+	// exactly once. Populated by Build once the graph has finished
+	// constructing.
+	RecursiveLOC int
 }
 
 type Condition func(Dependencies) bool
@@ -64,11 +90,49 @@ type Builder struct {
 	IncludeTests bool
 	// Whether to include standard library packages
 	IncludeStdlib bool
+	// Whether to expand each root in Roots into itself plus all of its
+	// descendant packages, as if "/..." had been appended to it.
+	Recursive bool
 	// The build context for processing imports.
 	BuildContext build.Context
+	// Loader selects how packages are resolved and loaded. The zero value,
+	// GoBuildLoader, preserves the original go/build-based behavior; set it
+	// to GoPackagesLoader for module-aware resolution via go/packages.
+	Loader Loader
+	// Matrix, if non-empty, causes Build to run once per build.Context
+	// (e.g. one per GOOS/GOARCH pair) and merge the results; see
+	// Dependencies.PerContext and Dependencies.EdgeContexts. BuildContext is
+	// ignored when Matrix is set. Use ExpandMatrix to build this slice from
+	// a list of GOOS/GOARCH pairs plus shared build tags.
+	Matrix []build.Context
+	// CollapseTo, if set, collapses the graph down to the granularity of
+	// Normalizer's output (e.g. one node per module instead of one per
+	// package) once the graph has finished building. See CollapsePrefixes
+	// and CollapseToModule.
+	CollapseTo Normalizer
+	// CollapseToModule, when CollapseTo is unset, derives a Normalizer
+	// automatically: under GoPackagesLoader it groups packages by their
+	// resolved module path; otherwise it falls back to the GOPATH-oriented
+	// heuristic in NormalizeModulePath.
+	CollapseToModule bool
+	// Concurrency bounds how many packages addAllPackages loads and
+	// measures at once. Zero (the default) uses runtime.GOMAXPROCS(0).
+	Concurrency int
+	// PreprocessCgo, if set, measures CgoLOC from the Go source files that
+	// `go tool cgo` itself generates from a package's CgoFiles, instead of
+	// from the CgoFiles as written. This better reflects the code that
+	// actually gets compiled, at the cost of invoking `go tool cgo` for
+	// every cgo package.
+	PreprocessCgo bool
 
 	// Internal
-	deps Dependencies
+	deps            Dependencies
+	moduleOf        map[Package]Package
+	mu              *sync.Mutex
+	inflightMu      *sync.Mutex
+	inflight        map[Package]*pkgResult
+	sem             chan struct{}
+	siblingContexts []build.Context
 }
 
 func (b *Builder) Build() (Dependencies, error) {
@@ -77,90 +141,56 @@ func (b *Builder) Build() (Dependencies, error) {
 		Ignored: NewSet(),
 		Info:    make(map[Package]*DependencyInfo),
 	}
-
-	err := b.addAllPackages(b.Roots)
-	if err == termination {
-		err = nil // Ignore termination condition.
-	}
-
-	return b.deps, err
-}
-
-func (b *Builder) addAllPackages(pkgs []Package) error {
-	for _, pkg := range pkgs {
-		// TODO: add support for recursive sub-packages.
-		includedName, err := b.addPackage(pkg)
-		if err != nil {
-			return err
-		}
-		if includedName == "" {
-			fmt.Fprintf(os.Stderr, "Warning: ignoring root package %q\n", pkg)
-		}
-	}
-	return nil
-}
-
-var termination = errors.New("termination condition met")
-
-// Recursively adds a package to the accumulated dependency graph.
-// If the package is not included, includedName will be empty.
-func (b *Builder) addPackage(pkgName Package) (includedName Package, err error) {
-	// Ignore cgo imports
-	if pkgName == "C" {
-		return "", nil
+	b.moduleOf = make(map[Package]Package)
+	b.mu = &sync.Mutex{}
+	b.inflightMu = &sync.Mutex{}
+	b.inflight = make(map[Package]*pkgResult)
+	concurrency := b.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
 	}
+	b.sem = make(chan struct{}, concurrency)
 
-	pkg, err := b.BuildContext.Import(string(pkgName), b.BaseDir, 0)
-	if err != nil {
-		return "", err
+	if len(b.Matrix) > 0 {
+		return b.buildMatrix()
 	}
 
-	pkgFullName := stripVendor(pkg.ImportPath)
-	if !b.isAccepted(pkg) {
-		b.deps.Ignored.Insert(pkgFullName)
-		return "", nil
+	var err error
+	if b.Loader == GoPackagesLoader {
+		// packages.Load understands "..." and module-aware resolution
+		// natively, including for modules living outside GOPATH, which the
+		// go/build-based expandRoots walk below cannot find. Hand it the
+		// patterns unexpanded and let it do its own expansion.
+		err = b.buildWithPackages(b.packagesPatterns(b.Roots))
+	} else {
+		err = b.addAllPackages(b.expandRoots(b.Roots))
 	}
-
-	if b.deps.Forward.Has(pkgFullName) {
-		// Package was included, but we don't need to walk its deps again.
-		return pkgFullName, nil
+	if err == termination {
+		err = nil // Ignore termination condition.
 	}
-
-	// Insert the package.
-	b.deps.Forward.Pkg(pkgFullName)
-
-	b.deps.Info[pkgFullName] = &DependencyInfo{
-		LOC: b.linesOfCode(pkg),
+	if err != nil {
+		return b.deps, err
 	}
 
-	for _, condition := range b.TerminationConditions {
-		if condition(b.deps) {
-			return pkgFullName, termination
-		}
+	if normalize := b.collapseNormalizer(); normalize != nil {
+		b.deps = collapseDependencies(b.deps, normalize)
 	}
 
-	for _, imp := range b.getImports(pkg) {
-		includedName, err := b.addPackage(imp)
-		if err != nil {
-			return pkgFullName, err
-		}
-		if includedName == "" {
-			// Package was not included, skip it.
-			continue
-		}
-
-		b.deps.Forward.Pkg(pkgFullName).Insert(includedName)
-	}
+	computeRecursiveLOC(b.deps)
 
-	return pkgFullName, nil
+	return b.deps, nil
 }
 
+var termination = errors.New("termination condition met")
+
 func (b *Builder) getImports(pkg *build.Package) []Package {
-	allImports := pkg.Imports
+	allImports := append([]string{}, pkg.Imports...)
 	if b.IncludeTests {
 		allImports = append(allImports, pkg.TestImports...)
 		allImports = append(allImports, pkg.XTestImports...)
 	}
+	allImports = append(allImports, b.conditionalImports(pkg)...)
+
 	var imports []Package
 	found := make(map[string]struct{})
 	for _, imp := range allImports {
@@ -223,26 +253,6 @@ func stripVendor(pkg string) Package {
 	return Package(pkg)
 }
 
-func (b *Builder) linesOfCode(pkg *build.Package) int {
-	loc := 0
-	files := append([]string{}, pkg.GoFiles...)
-	// TODO: Should we also include the c source files?
-	files = append(files, pkg.CgoFiles...)
-	if b.IncludeTests {
-		files = append(files, pkg.TestGoFiles...)
-		files = append(files, pkg.XTestGoFiles...)
-	}
-	for _, f := range files {
-		l, err := countLines(filepath.Join(pkg.Dir, f))
-		if err != nil {
-			log.Printf("ERROR: %v", err)
-			continue
-		}
-		loc += l
-	}
-	return loc
-}
-
 func countLines(file string) (int, error) {
 	f, err := os.Open(file)
 	if err != nil {
@@ -0,0 +1,146 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package deps
+
+import (
+	"fmt"
+	"go/build"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// linesOfCode measures pkg's source files, broken down by language. CgoLOC
+// is measured from the raw CgoFiles unless b.PreprocessCgo is set, in which
+// case it's measured from the Go source `go tool cgo` generates from them,
+// which better reflects what's actually compiled.
+func (b *Builder) linesOfCode(pkg *build.Package) DependencyInfo {
+	goFiles := append([]string{}, pkg.GoFiles...)
+	if b.IncludeTests {
+		goFiles = append(goFiles, pkg.TestGoFiles...)
+		goFiles = append(goFiles, pkg.XTestGoFiles...)
+	}
+
+	info := DependencyInfo{
+		GoLOC:  countFilesIn(pkg.Dir, goFiles),
+		CgoLOC: countFilesIn(pkg.Dir, pkg.CgoFiles),
+		AsmLOC: countFilesIn(pkg.Dir, pkg.SFiles),
+		CLOC:   countFilesIn(pkg.Dir, append(append([]string{}, pkg.CFiles...), append(pkg.CXXFiles, pkg.HFiles...)...)),
+	}
+
+	if b.PreprocessCgo && len(pkg.CgoFiles) > 0 {
+		if loc, err := preprocessedCgoLOC(pkg); err != nil {
+			log.Printf("ERROR: cgo preprocessing failed for %s: %v", pkg.ImportPath, err)
+		} else {
+			info.CgoLOC = loc
+		}
+	}
+
+	info.LOC = info.GoLOC + info.CgoLOC + info.AsmLOC + info.CLOC
+	return info
+}
+
+func countFilesIn(dir string, files []string) int {
+	loc := 0
+	for _, f := range files {
+		l, err := countLines(filepath.Join(dir, f))
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			continue
+		}
+		loc += l
+	}
+	return loc
+}
+
+// preprocessedCgoLOC runs `go tool cgo` over pkg's CgoFiles in a temporary
+// directory and counts lines in the *.cgo1.go files it emits, which are the
+// Go sources actually compiled in place of the originals, plus the
+// _cgo_gotypes.go file it generates alongside them.
+func preprocessedCgoLOC(pkg *build.Package) (int, error) {
+	objDir, err := os.MkdirTemp("", "godepq-cgo-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(objDir)
+
+	args := append([]string{"tool", "cgo", "-objdir", objDir}, pkg.CgoFiles...)
+	cmd := exec.Command("go", args...)
+	cmd.Dir = pkg.Dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return 0, fmt.Errorf("go tool cgo: %v: %s", err, out)
+	}
+
+	loc := 0
+	for _, f := range pkg.CgoFiles {
+		generated := filepath.Join(objDir, strings.TrimSuffix(f, ".go")+".cgo1.go")
+		l, err := countLines(generated)
+		if err != nil {
+			continue
+		}
+		loc += l
+	}
+	if l, err := countLines(filepath.Join(objDir, "_cgo_gotypes.go")); err == nil {
+		loc += l
+	}
+	return loc, nil
+}
+
+// computeRecursiveLOC populates DependencyInfo.RecursiveLOC for every
+// package in deps.Info: that package's own LOC plus the LOC of every
+// package reachable from it in deps.Forward, with shared dependencies
+// counted exactly once. It uses a single post-order walk (each package
+// processed only after all the packages it depends on), which is exact
+// when deps.Forward is acyclic. go/build does not reject import cycles, and
+// collapsing can merge packages into a cycle; a package on a cycle takes no
+// reachable set from the cycle member still being visited, so packages
+// further along that cycle can be left out of its RecursiveLOC.
+func computeRecursiveLOC(deps Dependencies) {
+	reachable := make(map[Package]map[Package]bool)
+
+	visited := make(map[Package]bool)
+	var order []Package
+	var visit func(Package)
+	visit = func(pkg Package) {
+		if visited[pkg] {
+			return
+		}
+		visited[pkg] = true
+		for child := range deps.Forward[pkg] {
+			visit(child)
+		}
+		order = append(order, pkg)
+	}
+	for pkg := range deps.Forward {
+		visit(pkg)
+	}
+
+	for _, pkg := range order {
+		set := map[Package]bool{pkg: true}
+		for child := range deps.Forward[pkg] {
+			set[child] = true
+			for dep := range reachable[child] {
+				set[dep] = true
+			}
+		}
+		reachable[pkg] = set
+
+		total := 0
+		for dep := range set {
+			if info := deps.Info[dep]; info != nil {
+				total += info.LOC
+			}
+		}
+		if info := deps.Info[pkg]; info != nil {
+			info.RecursiveLOC = total
+		}
+	}
+}
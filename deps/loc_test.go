@@ -0,0 +1,43 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package deps
+
+import "testing"
+
+func TestComputeRecursiveLOC(t *testing.T) {
+	deps := Dependencies{
+		Forward: NewGraph(),
+		Info:    make(map[Package]*DependencyInfo),
+	}
+	// Diamond: a depends on b and c, both of which depend on d.
+	deps.Forward.Pkg("a").Insert("b")
+	deps.Forward.Pkg("a").Insert("c")
+	deps.Forward.Pkg("b").Insert("d")
+	deps.Forward.Pkg("c").Insert("d")
+	deps.Forward.Pkg("d")
+
+	deps.Info["a"] = &DependencyInfo{LOC: 1}
+	deps.Info["b"] = &DependencyInfo{LOC: 2}
+	deps.Info["c"] = &DependencyInfo{LOC: 4}
+	deps.Info["d"] = &DependencyInfo{LOC: 8}
+
+	computeRecursiveLOC(deps)
+
+	want := map[Package]int{
+		"d": 8,
+		"b": 10, // b + d
+		"c": 12, // c + d
+		"a": 15, // a + b + c + d, with the shared d counted once
+	}
+	for pkg, wantLOC := range want {
+		if got := deps.Info[pkg].RecursiveLOC; got != wantLOC {
+			t.Errorf("RecursiveLOC[%q] = %d, want %d", pkg, got, wantLOC)
+		}
+	}
+}
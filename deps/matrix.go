@@ -0,0 +1,179 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package deps
+
+import (
+	"go/build"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Edge identifies a directed dependency from one package to another.
+type Edge struct {
+	From Package
+	To   Package
+}
+
+// ContextLabel returns a canonical, human-readable label for a build
+// context, e.g. "linux/amd64" or "linux/amd64+sqlite,osusergo" when
+// BuildTags are set. It is used to key Dependencies.PerContext and to
+// annotate Dependencies.EdgeContexts.
+func ContextLabel(ctx build.Context) string {
+	label := ctx.GOOS + "/" + ctx.GOARCH
+	if len(ctx.BuildTags) > 0 {
+		label += "+" + strings.Join(ctx.BuildTags, ",")
+	}
+	return label
+}
+
+// buildMatrix runs Build once per entry in b.Matrix and folds the results
+// together into a single Dependencies: Forward is the union of every
+// context's graph, Info and Ignored are merged, PerContext holds each
+// context's graph individually, and EdgeContexts records which contexts'
+// graphs contain each edge. Each context's build also follows the imports
+// of files that another context in the Matrix accepts (see
+// conditionalImports), so an edge that comes from such a file is recorded
+// for every context whose graph reaches the importing package, not only for
+// the contexts that accept the file.
+func (b *Builder) buildMatrix() (Dependencies, error) {
+	merged := Dependencies{
+		Forward:    NewGraph(),
+		Ignored:    NewSet(),
+		Info:       make(map[Package]*DependencyInfo),
+		PerContext: make(map[string]Dependencies),
+	}
+	edgeContexts := make(map[Edge][]string)
+
+	for _, ctx := range b.Matrix {
+		sub := *b
+		sub.BuildContext = ctx
+		sub.Matrix = nil               // avoid recursing back into matrix mode
+		sub.siblingContexts = b.Matrix // let conditionalImports see the other contexts
+
+		deps, err := sub.Build()
+		if err != nil {
+			return merged, err
+		}
+
+		label := ContextLabel(ctx)
+		merged.PerContext[label] = deps
+
+		for pkg, children := range deps.Forward {
+			merged.Forward.Pkg(pkg)
+			for child := range children {
+				merged.Forward.Pkg(pkg).Insert(child)
+				edge := Edge{From: pkg, To: child}
+				edgeContexts[edge] = append(edgeContexts[edge], label)
+			}
+		}
+		for pkg, info := range deps.Info {
+			if _, ok := merged.Info[pkg]; !ok {
+				// Copy rather than alias: computeRecursiveLOC below mutates
+				// RecursiveLOC on merged.Info's pointers, and info here is
+				// also reachable from merged.PerContext[label].Info, whose
+				// RecursiveLOC must keep reflecting that context's own
+				// graph, not the merged one.
+				infoCopy := *info
+				merged.Info[pkg] = &infoCopy
+			}
+		}
+		for pkg := range deps.Ignored {
+			merged.Ignored.Insert(pkg)
+		}
+	}
+
+	for edge, labels := range edgeContexts {
+		sort.Strings(labels)
+		edgeContexts[edge] = labels
+	}
+	merged.EdgeContexts = edgeContexts
+
+	computeRecursiveLOC(merged)
+
+	return merged, nil
+}
+
+// conditionalImports re-examines the files go/build set aside in
+// pkg.IgnoredGoFiles, re-testing each against the *other* contexts in a
+// Matrix run via MatchFile. pkg.IgnoredGoFiles is exactly the set of files
+// the active BuildContext already rejected, so re-testing it against that
+// same context would deterministically fail again; what actually recovers
+// conditional imports is checking whether a sibling context (set by
+// buildMatrix via b.siblingContexts) would have accepted the file instead.
+// Outside of a Matrix run there are no siblings to check, so this is a
+// no-op. Matching files are parsed for their import declarations only.
+func (b *Builder) conditionalImports(pkg *build.Package) []string {
+	if len(b.siblingContexts) == 0 {
+		return nil
+	}
+	currentLabel := ContextLabel(b.BuildContext)
+
+	var extra []string
+	seen := make(map[string]bool)
+	for _, name := range pkg.IgnoredGoFiles {
+		for _, ctx := range b.siblingContexts {
+			if ContextLabel(ctx) == currentLabel {
+				continue // the context that already excluded this file
+			}
+			match, err := ctx.MatchFile(pkg.Dir, name)
+			if err != nil || !match {
+				continue
+			}
+			for _, imp := range importsOfFile(filepath.Join(pkg.Dir, name)) {
+				if !seen[imp] {
+					seen[imp] = true
+					extra = append(extra, imp)
+				}
+			}
+			break
+		}
+	}
+	return extra
+}
+
+// importsOfFile parses just the import declarations of a Go source file,
+// without requiring the rest of the file to type-check.
+func importsOfFile(path string) []string {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, nil, parser.ImportsOnly)
+	if err != nil {
+		return nil
+	}
+	var imports []string
+	for _, imp := range file.Imports {
+		path, err := strconv.Unquote(imp.Path.Value)
+		if err != nil {
+			continue
+		}
+		imports = append(imports, path)
+	}
+	return imports
+}
+
+// ExpandMatrix builds a []build.Context from the cross product of gooss,
+// goarches, and a shared set of build tags, layered on top of base (which
+// supplies everything else, e.g. GOROOT/GOPATH). It's a convenience for
+// populating Builder.Matrix without constructing each build.Context by hand.
+func ExpandMatrix(base build.Context, gooss, goarches []string, buildTags []string) []build.Context {
+	var matrix []build.Context
+	for _, goos := range gooss {
+		for _, goarch := range goarches {
+			ctx := base
+			ctx.GOOS = goos
+			ctx.GOARCH = goarch
+			ctx.BuildTags = buildTags
+			matrix = append(matrix, ctx)
+		}
+	}
+	return matrix
+}
@@ -0,0 +1,113 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package deps
+
+import (
+	"go/build"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestContextLabel(t *testing.T) {
+	cases := []struct {
+		ctx  build.Context
+		want string
+	}{
+		{build.Context{GOOS: "linux", GOARCH: "amd64"}, "linux/amd64"},
+		{build.Context{GOOS: "linux", GOARCH: "amd64", BuildTags: []string{"sqlite"}}, "linux/amd64+sqlite"},
+		{build.Context{GOOS: "linux", GOARCH: "amd64", BuildTags: []string{"sqlite", "osusergo"}}, "linux/amd64+sqlite,osusergo"},
+	}
+	for _, c := range cases {
+		if got := ContextLabel(c.ctx); got != c.want {
+			t.Errorf("ContextLabel(%+v) = %q, want %q", c.ctx, got, c.want)
+		}
+	}
+}
+
+func TestConditionalImportsFindsSiblingOnlyImport(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "pkg.go", "package pkg\n")
+	writeFile(t, dir, "pkg_linux.go", "package pkg\n\nimport _ \"net\"\n")
+
+	linux := build.Default
+	linux.GOOS = "linux"
+	linux.GOARCH = "amd64"
+	darwin := build.Default
+	darwin.GOOS = "darwin"
+	darwin.GOARCH = "amd64"
+
+	pkg, err := darwin.ImportDir(dir, 0)
+	if err != nil {
+		t.Fatalf("ImportDir: %v", err)
+	}
+	if len(pkg.IgnoredGoFiles) != 1 || pkg.IgnoredGoFiles[0] != "pkg_linux.go" {
+		t.Fatalf("expected pkg_linux.go to be excluded from the darwin build, got IgnoredGoFiles=%v", pkg.IgnoredGoFiles)
+	}
+
+	b := &Builder{BuildContext: darwin, siblingContexts: []build.Context{darwin, linux}}
+	got := b.conditionalImports(pkg)
+
+	want := []string{"net"}
+	if len(got) != len(want) || got[0] != want[0] {
+		t.Errorf("conditionalImports = %v, want %v", got, want)
+	}
+}
+
+func TestConditionalImportsNoSiblings(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "pkg.go", "package pkg\n")
+	writeFile(t, dir, "pkg_linux.go", "package pkg\n\nimport _ \"net\"\n")
+
+	darwin := build.Default
+	darwin.GOOS = "darwin"
+	darwin.GOARCH = "amd64"
+
+	pkg, err := darwin.ImportDir(dir, 0)
+	if err != nil {
+		t.Fatalf("ImportDir: %v", err)
+	}
+
+	// Outside of a Matrix run, b.siblingContexts is empty: there's nothing to
+	// re-test IgnoredGoFiles against, so no extra imports should surface.
+	b := &Builder{BuildContext: darwin}
+	if got := b.conditionalImports(pkg); got != nil {
+		t.Errorf("conditionalImports with no siblings = %v, want nil", got)
+	}
+}
+
+func TestConditionalImportsSkipsItsOwnContext(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "pkg.go", "package pkg\n")
+	writeFile(t, dir, "pkg_linux.go", "package pkg\n\nimport _ \"net\"\n")
+
+	darwin := build.Default
+	darwin.GOOS = "darwin"
+	darwin.GOARCH = "amd64"
+
+	pkg, err := darwin.ImportDir(dir, 0)
+	if err != nil {
+		t.Fatalf("ImportDir: %v", err)
+	}
+
+	// The active context itself already rejected pkg_linux.go once (that's
+	// why it's in IgnoredGoFiles); it should be skipped rather than
+	// re-matched against itself, even if it's the only "sibling" present.
+	b := &Builder{BuildContext: darwin, siblingContexts: []build.Context{darwin}}
+	if got := b.conditionalImports(pkg); got != nil {
+		t.Errorf("conditionalImports with only its own context as sibling = %v, want nil", got)
+	}
+}
+
+func writeFile(t *testing.T, dir, name, contents string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
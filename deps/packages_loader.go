@@ -0,0 +1,188 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package deps
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// Loader selects which mechanism Builder uses to resolve import paths and
+// load package metadata.
+type Loader int
+
+const (
+	// GoBuildLoader resolves packages with go/build's BuildContext, the
+	// original, GOPATH-oriented behavior. It is the zero value so existing
+	// callers of Builder are unaffected.
+	GoBuildLoader Loader = iota
+	// GoPackagesLoader resolves packages with golang.org/x/tools/go/packages,
+	// which understands Go modules, replace directives, and workspace mode.
+	GoPackagesLoader
+)
+
+const packagesLoadMode = packages.NeedName |
+	packages.NeedFiles |
+	packages.NeedImports |
+	packages.NeedDeps
+
+// buildWithPackages is the GoPackagesLoader counterpart to addAllPackages. It
+// loads the full transitive closure of roots in one driver invocation and
+// folds the resulting graph into b.deps, applying the same Ignored/Included/
+// IncludeStdlib filters as the go/build path. roots come from
+// packagesPatterns rather than expandRoots: "..." wildcards (and Recursive's
+// "/..." patterns) are left for packages.Load itself to expand, since it
+// understands modules outside GOPATH that a go/build walk would miss.
+func (b *Builder) buildWithPackages(roots []Package) error {
+	cfg := &packages.Config{
+		Mode:  packagesLoadMode,
+		Dir:   b.BaseDir,
+		Tests: b.IncludeTests,
+	}
+
+	patterns := make([]string, len(roots))
+	for i, root := range roots {
+		patterns[i] = string(root)
+	}
+
+	pkgs, err := packages.Load(cfg, patterns...)
+	if err != nil {
+		return fmt.Errorf("unable to load packages: %v", err)
+	}
+
+	for _, pkg := range pkgs {
+		includedName, err := b.addPackageNode(pkg)
+		if err != nil {
+			return err
+		}
+		if includedName == "" {
+			fmt.Fprintf(os.Stderr, "Warning: ignoring root package %q\n", pkg.PkgPath)
+		}
+	}
+	return nil
+}
+
+// addPackageNode recursively adds a *packages.Package and its Imports to
+// b.deps, mirroring the semantics of addPackage for the go/build loader.
+func (b *Builder) addPackageNode(pkg *packages.Package) (includedName Package, err error) {
+	pkgFullName := stripVendor(pkg.PkgPath)
+
+	if !b.isAcceptedModulePackage(pkg) {
+		b.deps.Ignored.Insert(pkgFullName)
+		return "", nil
+	}
+
+	if b.deps.Forward.Has(pkgFullName) {
+		// Package was included, but we don't need to walk its deps again.
+		return pkgFullName, nil
+	}
+
+	// Insert the package before recursing so import cycles terminate.
+	b.deps.Forward.Pkg(pkgFullName)
+
+	if pkg.Module != nil {
+		b.moduleOf[pkgFullName] = Package(pkg.Module.Path)
+	}
+
+	goLOC := linesOfModuleFiles(moduleGoFiles(pkg))
+	b.deps.Info[pkgFullName] = &DependencyInfo{
+		LOC:   goLOC,
+		GoLOC: goLOC,
+	}
+
+	for _, condition := range b.TerminationConditions {
+		if condition(b.deps) {
+			return pkgFullName, termination
+		}
+	}
+
+	for _, imp := range sortedImports(pkg.Imports) {
+		if imp.PkgPath == "C" {
+			continue
+		}
+		childName, err := b.addPackageNode(imp)
+		if err != nil {
+			return pkgFullName, err
+		}
+		if childName == "" {
+			// Package was not included, skip it.
+			continue
+		}
+		b.deps.Forward.Pkg(pkgFullName).Insert(childName)
+	}
+
+	return pkgFullName, nil
+}
+
+// isAcceptedModulePackage applies the same Ignored/Included/IncludeStdlib
+// rules as isAccepted, adapted to a *packages.Package which carries no
+// Goroot field of its own.
+func (b *Builder) isAcceptedModulePackage(pkg *packages.Package) bool {
+	pkgFullName := stripVendor(pkg.PkgPath)
+	if b.isIgnored(pkgFullName) {
+		return false
+	}
+	if isStdlibPackage(pkg) && !b.IncludeStdlib {
+		return false
+	}
+	return b.isIncluded(pkgFullName)
+}
+
+// isStdlibPackage reports whether pkg belongs to the standard library. The
+// packages driver does not expose an equivalent of build.Package.Goroot, so
+// this is approximated the same way `go list` itself distinguishes std
+// packages: by the absence of a module, since GOROOT packages are never
+// part of the main module or any dependency module.
+func isStdlibPackage(pkg *packages.Package) bool {
+	return pkg.Module == nil
+}
+
+// sortedImports returns the values of an Imports map in a deterministic
+// order, since map iteration order is otherwise random and would make
+// Dependencies.Forward non-reproducible between runs.
+func sortedImports(imports map[string]*packages.Package) []*packages.Package {
+	paths := make([]string, 0, len(imports))
+	for path := range imports {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	sorted := make([]*packages.Package, len(paths))
+	for i, path := range paths {
+		sorted[i] = imports[path]
+	}
+	return sorted
+}
+
+// moduleGoFiles returns the Go source files that should be counted towards a
+// package's LOC, preferring CompiledGoFiles (which reflects build-tag
+// filtering and cgo preprocessing) and falling back to GoFiles.
+func moduleGoFiles(pkg *packages.Package) []string {
+	if len(pkg.CompiledGoFiles) > 0 {
+		return pkg.CompiledGoFiles
+	}
+	return pkg.GoFiles
+}
+
+func linesOfModuleFiles(files []string) int {
+	loc := 0
+	for _, f := range files {
+		l, err := countLines(f)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			continue
+		}
+		loc += l
+	}
+	return loc
+}
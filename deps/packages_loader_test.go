@@ -0,0 +1,78 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package deps
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestBuildWithPackagesGoPathMode(t *testing.T) {
+	// packages.Load falls back to classic GOPATH resolution (no go.mod
+	// needed) when GO111MODULE is off, which keeps this test hermetic.
+	t.Setenv("GO111MODULE", "off")
+	gopath := t.TempDir()
+	const root = "packagestest"
+	writeTestPackage(t, gopath, root+"/a", "package a\n\nimport _ \""+root+"/b\"\n")
+	writeTestPackage(t, gopath, root+"/b", "package b\n")
+	t.Setenv("GOPATH", gopath)
+
+	b := &Builder{
+		Roots:  []Package{Package(root + "/a")},
+		Loader: GoPackagesLoader,
+		// isStdlibPackage can only tell GOROOT packages apart from module
+		// packages by the absence of a Module; plain GOPATH packages have no
+		// Module either, so without this they'd be mistaken for stdlib and
+		// dropped.
+		IncludeStdlib: true,
+	}
+	deps, err := b.Build()
+	if err != nil {
+		t.Fatalf("Build returned error: %v", err)
+	}
+
+	for _, pkg := range []Package{root + "/a", root + "/b"} {
+		if !deps.Forward.Has(pkg) {
+			t.Errorf("expected %q in the graph", pkg)
+		}
+	}
+	if !deps.Forward.Pkg(root + "/a").Has(root + "/b") {
+		t.Errorf("expected %s/a -> %s/b", root, root)
+	}
+	if _, ok := deps.Info[root+"/a"]; !ok {
+		t.Errorf("expected Info entry for %s/a", root)
+	}
+}
+
+func TestBuildWithPackagesRespectsIgnored(t *testing.T) {
+	t.Setenv("GO111MODULE", "off")
+	gopath := t.TempDir()
+	const root = "packagestest2"
+	writeTestPackage(t, gopath, root+"/a", "package a\n\nimport _ \""+root+"/b\"\n")
+	writeTestPackage(t, gopath, root+"/b", "package b\n")
+	t.Setenv("GOPATH", gopath)
+
+	b := &Builder{
+		Roots:         []Package{Package(root + "/a")},
+		Loader:        GoPackagesLoader,
+		IncludeStdlib: true,
+		Ignored:       []*regexp.Regexp{regexp.MustCompile(root + "/b$")},
+	}
+	deps, err := b.Build()
+	if err != nil {
+		t.Fatalf("Build returned error: %v", err)
+	}
+
+	if deps.Forward.Has(root + "/b") {
+		t.Errorf("expected %s/b to be ignored, not added to the graph", root)
+	}
+	if !deps.Ignored.Has(root + "/b") {
+		t.Errorf("expected %s/b in Ignored", root)
+	}
+}
@@ -0,0 +1,227 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package deps
+
+import (
+	"context"
+	"fmt"
+	"go/build"
+	"os"
+	"sort"
+	"sync"
+)
+
+// pkgResult is the outcome of loading a single package, shared between the
+// goroutine that does the work and any other goroutine that asks for the
+// same package while it's in flight. ready is closed as soon as name/err are
+// safe to read, which happens once the package has been resolved and either
+// rejected or inserted into b.deps.Forward -- not once its subtree has
+// finished loading. That distinction is what lets a second visitor that
+// arrives via an import cycle stop waiting instead of blocking forever on
+// the very call stack it is itself nested inside.
+type pkgResult struct {
+	ready chan struct{}
+	name  Package
+	err   error
+}
+
+func newPkgResult() *pkgResult {
+	return &pkgResult{ready: make(chan struct{})}
+}
+
+// addAllPackages adds pkgs, and everything they transitively import, to
+// b.deps. Packages are loaded and measured concurrently, bounded by
+// b.sem, with in-flight loads deduplicated via b.inflight so two goroutines
+// never import the same path at once. A TerminationCondition that fires
+// stops the walk below the package that fired it. ctx is cancelled once a
+// root's load returns an error or that termination; from then on, packages
+// whose load has not yet begun are skipped. Loads already under way,
+// including other subtrees of the same root, run to completion.
+func (b *Builder) addAllPackages(pkgs []Package) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var errMu sync.Mutex
+	var firstErr error
+	recordErr := func(err error) {
+		errMu.Lock()
+		defer errMu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, pkg := range pkgs {
+		pkg := pkg
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			includedName, err := b.addPackageAsync(ctx, pkg)
+			if err != nil {
+				recordErr(err)
+				return
+			}
+			if includedName == "" {
+				fmt.Fprintf(os.Stderr, "Warning: ignoring root package %q\n", pkg)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr == termination {
+		return nil
+	}
+	return firstErr
+}
+
+// addPackageAsync is the concurrent counterpart of the original recursive
+// addPackage: it resolves pkgName, dedupes against any in-flight or
+// already-finished load of the same path, and recurses into its imports.
+// If the package is not included, the returned Package is empty.
+func (b *Builder) addPackageAsync(ctx context.Context, pkgName Package) (Package, error) {
+	// Ignore cgo imports.
+	if pkgName == "C" {
+		return "", nil
+	}
+
+	b.inflightMu.Lock()
+	if res, ok := b.inflight[pkgName]; ok {
+		b.inflightMu.Unlock()
+		// Waiting on res.ready rather than on the full load completing is
+		// what keeps a real import cycle (a -> b -> a) from deadlocking:
+		// by the time pkgName is visible in b.inflight a second time, a's
+		// own goroutine has already inserted it into b.deps.Forward and
+		// closed ready, even though a's subtree (the wg.Wait() below) is
+		// still in progress further up this very call stack.
+		<-res.ready
+		return res.name, res.err
+	}
+	res := newPkgResult()
+	b.inflight[pkgName] = res
+	b.inflightMu.Unlock()
+
+	return b.loadPackage(ctx, pkgName, res)
+}
+
+func (b *Builder) loadPackage(ctx context.Context, pkgName Package, res *pkgResult) (Package, error) {
+	select {
+	case <-ctx.Done():
+		res.name, res.err = "", termination
+		close(res.ready)
+		return res.name, res.err
+	default:
+	}
+
+	pkg, err := b.acquireAndImport(pkgName)
+	if err != nil {
+		res.name, res.err = "", err
+		close(res.ready)
+		return res.name, res.err
+	}
+
+	pkgFullName := stripVendor(pkg.ImportPath)
+
+	b.mu.Lock()
+	if !b.isAccepted(pkg) {
+		b.deps.Ignored.Insert(pkgFullName)
+		b.mu.Unlock()
+		res.name, res.err = "", nil
+		close(res.ready)
+		return res.name, res.err
+	}
+	if b.deps.Forward.Has(pkgFullName) {
+		// Package was included, but we don't need to walk its deps again.
+		b.mu.Unlock()
+		res.name, res.err = pkgFullName, nil
+		close(res.ready)
+		return res.name, res.err
+	}
+	// Insert the package, and unblock anyone dedup-waiting on it, before
+	// recursing so import cycles terminate.
+	b.deps.Forward.Pkg(pkgFullName)
+	b.mu.Unlock()
+	res.name, res.err = pkgFullName, nil
+	close(res.ready)
+
+	info := b.acquireAndCountLOC(pkg)
+
+	b.mu.Lock()
+	b.deps.Info[pkgFullName] = &info
+	terminated := false
+	for _, condition := range b.TerminationConditions {
+		if condition(b.deps) {
+			terminated = true
+			break
+		}
+	}
+	b.mu.Unlock()
+	if terminated {
+		return pkgFullName, termination
+	}
+
+	// Sort so that, regardless of which goroutine finishes first, edges are
+	// inserted in the same order every run.
+	imports := b.getImports(pkg)
+	sort.Slice(imports, func(i, j int) bool { return imports[i] < imports[j] })
+
+	children := make([]Package, len(imports))
+	errs := make([]error, len(imports))
+	var wg sync.WaitGroup
+	for i, imp := range imports {
+		i, imp := i, imp
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			children[i], errs[i] = b.addPackageAsync(ctx, imp)
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil && err != termination {
+			return pkgFullName, err
+		}
+	}
+
+	b.mu.Lock()
+	for _, child := range children {
+		if child == "" {
+			continue
+		}
+		b.deps.Forward.Pkg(pkgFullName).Insert(child)
+	}
+	b.mu.Unlock()
+
+	for _, err := range errs {
+		if err == termination {
+			return pkgFullName, termination
+		}
+	}
+
+	return pkgFullName, nil
+}
+
+// acquireAndImport runs BuildContext.Import behind b.sem: it's I/O bound and
+// safe to run concurrently across packages, but only up to Concurrency
+// workers at a time.
+func (b *Builder) acquireAndImport(pkgName Package) (*build.Package, error) {
+	b.sem <- struct{}{}
+	defer func() { <-b.sem }()
+	return b.BuildContext.Import(string(pkgName), b.BaseDir, 0)
+}
+
+// acquireAndCountLOC runs linesOfCode behind b.sem for the same reason as
+// acquireAndImport.
+func (b *Builder) acquireAndCountLOC(pkg *build.Package) DependencyInfo {
+	b.sem <- struct{}{}
+	defer func() { <-b.sem }()
+	return b.linesOfCode(pkg)
+}
@@ -0,0 +1,153 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package deps
+
+import (
+	"go/build"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestPackage creates a minimal GOPATH package under gopath/src so it
+// can be resolved with an ordinary build.Context.
+func writeTestPackage(t *testing.T, gopath, importPath, source string) {
+	t.Helper()
+	dir := filepath.Join(gopath, "src", filepath.FromSlash(importPath))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Base(importPath)
+	if err := os.WriteFile(filepath.Join(dir, name+".go"), []byte(source), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddAllPackagesDedupesDiamondDependency(t *testing.T) {
+	// go/build.Import resolves via go.mod/GO111MODULE when present; force
+	// classic GOPATH resolution so ctx.GOPATH below is actually consulted.
+	t.Setenv("GO111MODULE", "off")
+	gopath := t.TempDir()
+	const root = "pooltest"
+	writeTestPackage(t, gopath, root+"/a", "package a\n\nimport (\n\t_ \""+root+"/b\"\n\t_ \""+root+"/c\"\n)\n")
+	writeTestPackage(t, gopath, root+"/b", "package b\n\nimport _ \""+root+"/d\"\n")
+	writeTestPackage(t, gopath, root+"/c", "package c\n\nimport _ \""+root+"/d\"\n")
+	writeTestPackage(t, gopath, root+"/d", "package d\n")
+
+	ctx := build.Default
+	ctx.GOPATH = gopath
+
+	b := &Builder{
+		Roots:        []Package{Package(root + "/a")},
+		BuildContext: ctx,
+		Concurrency:  4,
+	}
+	deps, err := b.Build()
+	if err != nil {
+		t.Fatalf("Build returned error: %v", err)
+	}
+
+	for _, pkg := range []Package{root + "/a", root + "/b", root + "/c", root + "/d"} {
+		if !deps.Forward.Has(pkg) {
+			t.Errorf("expected %q in the graph", pkg)
+		}
+	}
+	if !deps.Forward.Pkg(root + "/a").Has(root + "/b") {
+		t.Errorf("expected %s/a -> %s/b", root, root)
+	}
+	if !deps.Forward.Pkg(root + "/a").Has(root + "/c") {
+		t.Errorf("expected %s/a -> %s/c", root, root)
+	}
+	if !deps.Forward.Pkg(root + "/b").Has(root + "/d") {
+		t.Errorf("expected %s/b -> %s/d", root, root)
+	}
+	if !deps.Forward.Pkg(root + "/c").Has(root + "/d") {
+		t.Errorf("expected %s/c -> %s/d", root, root)
+	}
+
+	// d is reachable via both b and c; concurrent loads must dedup to a
+	// single Info entry rather than loading/counting it twice.
+	if _, ok := deps.Info[root+"/d"]; !ok {
+		t.Fatalf("expected Info entry for %s/d", root)
+	}
+	if len(deps.Info) != 4 {
+		t.Errorf("got %d Info entries, want 4 (one per package, d counted once): %v", len(deps.Info), deps.Info)
+	}
+}
+
+func TestAddAllPackagesHandlesImportCycle(t *testing.T) {
+	// go/build itself doesn't reject import cycles (only the compiler does),
+	// so a -> b -> a is a real input the concurrent dedup in pool.go must
+	// survive without deadlocking.
+	t.Setenv("GO111MODULE", "off")
+	gopath := t.TempDir()
+	const root = "pooltest3"
+	writeTestPackage(t, gopath, root+"/a", "package a\n\nimport _ \""+root+"/b\"\n")
+	writeTestPackage(t, gopath, root+"/b", "package b\n\nimport _ \""+root+"/a\"\n")
+
+	ctx := build.Default
+	ctx.GOPATH = gopath
+
+	b := &Builder{
+		Roots:        []Package{Package(root + "/a")},
+		BuildContext: ctx,
+		Concurrency:  4,
+	}
+
+	done := make(chan struct{})
+	var deps Dependencies
+	var err error
+	go func() {
+		deps, err = b.Build()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Build deadlocked on an import cycle")
+	}
+
+	if err != nil {
+		t.Fatalf("Build returned error: %v", err)
+	}
+	if !deps.Forward.Has(root+"/a") || !deps.Forward.Has(root+"/b") {
+		t.Fatalf("expected both cyclic packages in the graph: %v", deps.Forward)
+	}
+	if !deps.Forward.Pkg(root+"/a").Has(root+"/b") || !deps.Forward.Pkg(root+"/b").Has(root+"/a") {
+		t.Errorf("expected the cycle's edges to both be recorded")
+	}
+}
+
+func TestAddAllPackagesTerminationDoesNotHang(t *testing.T) {
+	t.Setenv("GO111MODULE", "off")
+	gopath := t.TempDir()
+	const root = "pooltest2"
+	writeTestPackage(t, gopath, root+"/a", "package a\n\nimport (\n\t_ \""+root+"/b\"\n\t_ \""+root+"/c\"\n)\n")
+	writeTestPackage(t, gopath, root+"/b", "package b\n")
+	writeTestPackage(t, gopath, root+"/c", "package c\n")
+
+	ctx := build.Default
+	ctx.GOPATH = gopath
+
+	b := &Builder{
+		Roots:        []Package{Package(root + "/a")},
+		BuildContext: ctx,
+		Concurrency:  2,
+		TerminationConditions: []Condition{
+			func(d Dependencies) bool { return len(d.Info) >= 1 },
+		},
+	}
+	// Termination is swallowed by Build; the assertion here is really that
+	// this call returns at all instead of deadlocking outstanding workers.
+	if _, err := b.Build(); err != nil {
+		t.Fatalf("Build returned error: %v", err)
+	}
+}
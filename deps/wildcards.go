@@ -0,0 +1,138 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package deps
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// expandRoots expands any "..." wildcard in roots (e.g. "./..." or
+// "github.com/foo/bar/...") into the concrete import paths it matches, and,
+// when b.Recursive is set, additionally expands every non-wildcard root into
+// itself plus all of its descendant packages. It mirrors `go build ./...`:
+// vendor, testdata, and dot-prefixed directories are never walked into.
+func (b *Builder) expandRoots(roots []Package) []Package {
+	var expanded []Package
+	seen := make(map[Package]bool)
+	add := func(pkg Package) {
+		if !seen[pkg] {
+			seen[pkg] = true
+			expanded = append(expanded, pkg)
+		}
+	}
+
+	for _, root := range roots {
+		switch {
+		case strings.Contains(string(root), "..."):
+			for _, pkg := range b.matchWildcard(string(root)) {
+				add(pkg)
+			}
+		case b.Recursive:
+			add(root)
+			for _, pkg := range b.matchWildcard(string(root) + "/...") {
+				add(pkg)
+			}
+		default:
+			add(root)
+		}
+	}
+	return expanded
+}
+
+// packagesPatterns adapts roots for GoPackagesLoader, where expansion is
+// packages.Load's job rather than expandRoots's: "..." patterns are passed
+// straight through, and Recursive is translated into the same "root/..."
+// pattern packages.Load already knows how to expand, instead of being
+// resolved by a go/build filesystem walk.
+func (b *Builder) packagesPatterns(roots []Package) []Package {
+	var patterns []Package
+	for _, root := range roots {
+		patterns = append(patterns, root)
+		if b.Recursive && !strings.Contains(string(root), "...") {
+			patterns = append(patterns, root+"/...")
+		}
+	}
+	return patterns
+}
+
+// matchWildcard resolves a single "..." pattern to the import paths it
+// matches. Patterns beginning with "." or "/" are treated as filesystem
+// paths rooted at b.BaseDir (as with `go build`); anything else is treated
+// as a GOPATH/GOROOT import path prefix and is searched for across every
+// directory returned by BuildContext.SrcDirs.
+func (b *Builder) matchWildcard(pattern string) []Package {
+	if strings.HasPrefix(pattern, ".") || filepath.IsAbs(pattern) {
+		return b.matchWildcardFS(pattern)
+	}
+	return b.matchWildcardImportPath(pattern)
+}
+
+func (b *Builder) matchWildcardFS(pattern string) []Package {
+	prefix := strings.TrimSuffix(pattern, "...")
+	root := filepath.Join(b.BaseDir, filepath.FromSlash(prefix))
+
+	var matches []Package
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path != root && shouldSkipDir(filepath.Base(path)) {
+			return filepath.SkipDir
+		}
+		pkg, ferr := b.BuildContext.Import(".", path, 0)
+		if ferr != nil {
+			// No buildable Go source in this directory; keep walking.
+			return nil
+		}
+		matches = append(matches, stripVendor(pkg.ImportPath))
+		return nil
+	})
+	return matches
+}
+
+func (b *Builder) matchWildcardImportPath(pattern string) []Package {
+	prefix := strings.TrimSuffix(pattern, "...")
+
+	var matches []Package
+	for _, srcDir := range b.BuildContext.SrcDirs() {
+		filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() {
+				return nil
+			}
+			if shouldSkipDir(filepath.Base(path)) {
+				return filepath.SkipDir
+			}
+			rel, rerr := filepath.Rel(srcDir, path)
+			if rerr != nil || rel == "." {
+				return nil
+			}
+			importPath := filepath.ToSlash(rel)
+			if !strings.HasPrefix(importPath, prefix) {
+				return nil
+			}
+			if _, ierr := b.BuildContext.Import(importPath, b.BaseDir, 0); ierr != nil {
+				return nil
+			}
+			matches = append(matches, Package(importPath))
+			return nil
+		})
+	}
+	return matches
+}
+
+// shouldSkipDir reports whether a directory should be excluded from wildcard
+// expansion, matching the rules `go build` itself applies to "...".
+func shouldSkipDir(name string) bool {
+	return name == "vendor" || name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")
+}
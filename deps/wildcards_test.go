@@ -0,0 +1,112 @@
+/*
+Copyright (c) 2013-2016 the Godepq Authors
+
+Use of this source code is governed by a MIT-style
+license that can be found in the LICENSE file or at
+https://opensource.org/licenses/MIT.
+*/
+
+package deps
+
+import (
+	"go/build"
+	"testing"
+)
+
+func TestExpandRootsWildcard(t *testing.T) {
+	t.Setenv("GO111MODULE", "off")
+	gopath := t.TempDir()
+	const root = "wildcardtest"
+	writeTestPackage(t, gopath, root+"/a", "package a\n")
+	writeTestPackage(t, gopath, root+"/a/b", "package b\n")
+	writeTestPackage(t, gopath, root+"/c", "package c\n")
+
+	ctx := build.Default
+	ctx.GOPATH = gopath
+
+	b := &Builder{BuildContext: ctx}
+	got := b.expandRoots([]Package{root + "/a/..."})
+
+	// matchWildcardImportPath matches on the "prefix/" string, so it finds
+	// descendants of the pattern's directory but not the directory itself;
+	// callers wanting that one too list it explicitly alongside the pattern.
+	want := map[Package]bool{root + "/a/b": true}
+	if len(got) != len(want) {
+		t.Fatalf("expandRoots(%q/a/...) = %v, want %v", root, got, want)
+	}
+	for _, pkg := range got {
+		if !want[pkg] {
+			t.Errorf("unexpected package %q in expansion", pkg)
+		}
+	}
+}
+
+func TestExpandRootsRecursive(t *testing.T) {
+	t.Setenv("GO111MODULE", "off")
+	gopath := t.TempDir()
+	const root = "recursivetest"
+	writeTestPackage(t, gopath, root, "package "+root+"\n")
+	writeTestPackage(t, gopath, root+"/sub", "package sub\n")
+
+	ctx := build.Default
+	ctx.GOPATH = gopath
+
+	b := &Builder{BuildContext: ctx, Recursive: true}
+	got := b.expandRoots([]Package{root})
+
+	want := map[Package]bool{root: true, root + "/sub": true}
+	if len(got) != len(want) {
+		t.Fatalf("expandRoots(%q) with Recursive = %v, want %v", root, got, want)
+	}
+	for _, pkg := range got {
+		if !want[pkg] {
+			t.Errorf("unexpected package %q in expansion", pkg)
+		}
+	}
+}
+
+func TestPackagesPatterns(t *testing.T) {
+	cases := []struct {
+		name      string
+		roots     []Package
+		recursive bool
+		want      []Package
+	}{
+		{
+			name:  "wildcard passed through unexpanded",
+			roots: []Package{"example.com/foo/..."},
+			want:  []Package{"example.com/foo/..."},
+		},
+		{
+			name:  "plain root left alone without Recursive",
+			roots: []Package{"example.com/foo"},
+			want:  []Package{"example.com/foo"},
+		},
+		{
+			name:      "Recursive appends a /... pattern",
+			roots:     []Package{"example.com/foo"},
+			recursive: true,
+			want:      []Package{"example.com/foo", "example.com/foo/..."},
+		},
+		{
+			name:      "Recursive is a no-op on an already-wildcarded root",
+			roots:     []Package{"example.com/foo/..."},
+			recursive: true,
+			want:      []Package{"example.com/foo/..."},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b := &Builder{Recursive: c.recursive}
+			got := b.packagesPatterns(c.roots)
+			if len(got) != len(c.want) {
+				t.Fatalf("packagesPatterns(%v) = %v, want %v", c.roots, got, c.want)
+			}
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Errorf("packagesPatterns(%v)[%d] = %q, want %q", c.roots, i, got[i], c.want[i])
+				}
+			}
+		})
+	}
+}